@@ -0,0 +1,369 @@
+/*
+Copyright © 2021 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package extract
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/sirupsen/logrus"
+)
+
+// flowTuple is a direction-agnostic 5-tuple key: both orderings of a flow's
+// endpoints hash to the same bucket, since a packet seen on the wire may
+// travel in either direction relative to how the triggering event recorded
+// src/dest.
+type flowTuple struct {
+	ipA, ipB     string
+	portA, portB uint16
+	proto        layers.IPProtocol
+}
+
+func newFlowTuple(srcIP, dstIP string, srcPort, dstPort uint16, proto layers.IPProtocol) flowTuple {
+	if srcIP > dstIP || (srcIP == dstIP && srcPort > dstPort) {
+		srcIP, dstIP = dstIP, srcIP
+		srcPort, dstPort = dstPort, srcPort
+	}
+	return flowTuple{ipA: srcIP, ipB: dstIP, portA: srcPort, portB: dstPort, proto: proto}
+}
+
+// protoFromName maps an EVE "proto" field to the gopacket IP protocol number
+// used to build a flowTuple. Unknown protocols return 0. decodeFlowTuple
+// only builds TCP and UDP tuples, so an event with any other proto
+// (including ICMP) is never matched by tuple.
+func protoFromName(name string) layers.IPProtocol {
+	switch strings.ToUpper(name) {
+	case "TCP":
+		return layers.IPProtocolTCP
+	case "UDP":
+		return layers.IPProtocolUDP
+	case "ICMP":
+		return layers.IPProtocolICMPv4
+	default:
+		return 0
+	}
+}
+
+// decodeFlowTuple decodes just enough of a packet (Ethernet/IP/TCP|UDP) to
+// build its flowTuple. Packets without a recognized transport layer are
+// skipped.
+func decodeFlowTuple(data []byte) (flowTuple, bool) {
+	packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	netLayer := packet.NetworkLayer()
+	transLayer := packet.TransportLayer()
+	if netLayer == nil || transLayer == nil {
+		return flowTuple{}, false
+	}
+	if _, _, ok := outerTransportPorts(packet); !ok {
+		return flowTuple{}, false
+	}
+	src, dst := netLayer.NetworkFlow().Endpoints()
+
+	var srcPort, dstPort uint16
+	var proto layers.IPProtocol
+	switch t := transLayer.(type) {
+	case *layers.TCP:
+		srcPort, dstPort = uint16(t.SrcPort), uint16(t.DstPort)
+		proto = layers.IPProtocolTCP
+	case *layers.UDP:
+		srcPort, dstPort = uint16(t.SrcPort), uint16(t.DstPort)
+		proto = layers.IPProtocolUDP
+	default:
+		return flowTuple{}, false
+	}
+
+	return newFlowTuple(src.String(), dst.String(), srcPort, dstPort, proto), true
+}
+
+// batchTarget tracks the output side of a single event being extracted as
+// part of an ExtractPcapBatch run.
+type batchTarget struct {
+	event         Event
+	tuple         flowTuple
+	eventFlowPair *EndpointPair
+	outfile       *os.File
+	writer        *pcapgo.Writer
+	ngWrite       *ngOutput
+	lastTimestamp time.Time
+	retired       bool
+	closed        bool
+}
+
+// writePacket writes data, read from fName via handle, against whichever
+// output format t was opened with.
+func (t *batchTarget) writePacket(fName string, handle *pcap.Handle, ci gopacket.CaptureInfo, data []byte) {
+	if t.ngWrite != nil {
+		t.ngWrite.writePacket(fName, handle, ci, data, t.event)
+	} else {
+		t.writer.WritePacket(ci, data)
+	}
+}
+
+// observe records a packet known to belong to t's flow: if FlowTimeout has
+// elapsed since the last one, t retires instead of writing this one.
+// Returns whether the packet was written.
+func (t *batchTarget) observe(fName string, handle *pcap.Handle, ci gopacket.CaptureInfo, data []byte) bool {
+	if !t.lastTimestamp.IsZero() && ci.Timestamp.After(t.lastTimestamp.Add(FlowTimeout)) {
+		t.retire()
+		return false
+	}
+	t.writePacket(fName, handle, ci, data)
+	t.lastTimestamp = ci.Timestamp
+	return true
+}
+
+// retireStale retires and closes every target in targets that's already
+// matched at least one packet but hasn't matched one within FlowTimeout of
+// lastSeen, the latest timestamp actually read from pcap so far. A target
+// only ever runs this check itself through observe() when one of its own
+// packets comes up again - so a flow that has genuinely ended would
+// otherwise never retire, keeping the whole scan alive through every
+// remaining file. Returns how many targets were retired, to subtract from
+// the active count.
+func retireStale(targets []*batchTarget, lastSeen time.Time) int {
+	retired := 0
+	for _, t := range targets {
+		if t.retired || t.lastTimestamp.IsZero() {
+			continue
+		}
+		if lastSeen.After(t.lastTimestamp.Add(FlowTimeout)) {
+			t.retire()
+			retired++
+		}
+	}
+	return retired
+}
+
+// retire marks t as done and closes its output file immediately, rather
+// than leaving it open for the lifetime of the whole batch run - with
+// thousands of events, the latter exhausts the process's file descriptor
+// limit long before the scan finishes.
+func (t *batchTarget) retire() {
+	t.retired = true
+	t.close()
+}
+
+func (t *batchTarget) close() {
+	if t.closed {
+		return
+	}
+	t.closed = true
+	if t.ngWrite != nil {
+		t.ngWrite.flush()
+	}
+	t.outfile.Close()
+}
+
+/*
+ExtractPcapBatch extracts one output pcap per event in events, scanning the
+pcap files under config.PcapLogDirectory at most once regardless of how many
+events are given. A merged BPF filter ("(flow1) or (flow2) or ...") is
+pushed down to libpcap so only packets that could match at least one event
+reach userspace.
+
+Events with no tunnel (the common case) are dispatched by hashing each
+packet's outer 5-tuple and looking up which events it belongs to, same as
+the per-packet cost of a single ExtractPcapFile run. Events with
+event.Tunnel.Depth > 0 can't be dispatched that way - decodeFlowTuple only
+ever sees the outer tuple, which for encapsulations like GRE carries no
+TCP/UDP ports to hash on - so those are instead checked one at a time
+against every packet via filterTunnel, the same matcher ExtractPcapFile
+uses. config.OutputFormat is honored per target exactly as it is there too.
+
+An event is retired, and its output file closed, once FlowTimeout has
+elapsed between its last matched packet and a later one still being read
+for some other event. Since a retired flow's own tuple may never come up
+again to trigger that check, every still-active target is also swept for
+retirement at the end of each file, against the last timestamp read from
+it - not wall-clock time, since this replays historic capture. This keeps
+both memory and open file descriptors bounded when processing large
+batches against hours of rotated pcap.
+
+Per-event output files are named "<config.OutputName>.<index>", matching
+the index of the event in events.
+*/
+func ExtractPcapBatch(events []Event, config ExtractPcapConfig) error {
+	if len(events) == 0 {
+		return errors.New("No events to extract")
+	}
+
+	tunnelDecoders, err := newTunnelDecoders(config.TunnelDecoders)
+	if err != nil {
+		return err
+	}
+
+	targets := make([]*batchTarget, 0, len(events))
+	bpfClauses := make([]string, 0, len(events))
+
+	for i, event := range events {
+		outName := fmt.Sprintf("%s.%d", config.OutputName, i)
+		outfile, err := os.Create(outName)
+		if err != nil {
+			logrus.Error("Can't open pcap output file: ", err)
+			return err
+		}
+
+		eventFlowPair, err := buildEndpoints(event)
+		if err != nil {
+			logrus.Error("Can't build endpoints: ", err)
+			outfile.Close()
+			for _, t := range targets {
+				t.close()
+			}
+			return err
+		}
+
+		target := &batchTarget{event: event, eventFlowPair: eventFlowPair, outfile: outfile}
+		if config.OutputFormat == "pcapng" {
+			target.ngWrite, err = newNgOutput(outfile)
+			if err != nil {
+				logrus.Error("Can't write to output file: ", err)
+				outfile.Close()
+				for _, t := range targets {
+					t.close()
+				}
+				return err
+			}
+		} else {
+			target.writer = pcapgo.NewWriter(outfile)
+			if err := target.writer.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+				logrus.Error("Can't write to output file: ", err)
+				outfile.Close()
+				for _, t := range targets {
+					t.close()
+				}
+				return err
+			}
+		}
+
+		if event.Tunnel.Depth == 0 {
+			target.tuple = newFlowTuple(event.SrcIP.String(), event.DestIP.String(), event.SrcPort, event.DestPort, protoFromName(event.Proto))
+		}
+		targets = append(targets, target)
+
+		if config.SkipBpf {
+			continue
+		}
+		clause, err := buildBPF(event)
+		if err != nil {
+			logrus.Warning(err)
+			continue
+		}
+		bpfClauses = append(bpfClauses, "("+clause+")")
+	}
+
+	mergedBPF := strings.Join(bpfClauses, " or ")
+
+	byTuple := make(map[flowTuple][]*batchTarget, len(targets))
+	var tunneled []*batchTarget
+	for _, t := range targets {
+		if t.event.Tunnel.Depth > 0 {
+			tunneled = append(tunneled, t)
+		} else {
+			byTuple[t.tuple] = append(byTuple[t.tuple], t)
+		}
+	}
+
+	pcapFileList := NewPcapFileList(config.PcapLogDirectory, Event{}, config.FileFormat)
+	if pcapFileList == nil {
+		return errors.New("Problem when building pcap file list")
+	}
+
+	start := time.Now()
+	var pktCount uint64
+	var lastSeen time.Time
+	active := len(targets)
+
+	for active > 0 {
+		fName, err := pcapFileList.GetNext()
+		if err != nil {
+			switch err.(type) {
+			case ErrOutOfFiles, *ErrOutOfFiles:
+				logrus.Debugf("No more pcap files: %s\n", err)
+			default:
+				logrus.Warning(err)
+			}
+			break
+		}
+
+		logrus.Debugf("Reading packets from %s", fName)
+		handleRead, err := openPcapReaderHandle(fName, mergedBPF)
+		if err != nil {
+			logrus.Warningf("Can't open %s: %s", fName, err)
+			continue
+		}
+
+		for {
+			data, ci, err := handleRead.ReadPacketData()
+			switch {
+			case err == io.EOF:
+				goto NextFile
+			case err != nil:
+				logrus.Warningf("Failed to read packet: %s\n", err)
+				continue
+			}
+			lastSeen = ci.Timestamp
+
+			if tuple, ok := decodeFlowTuple(data); ok {
+				for _, t := range byTuple[tuple] {
+					if t.retired {
+						continue
+					}
+					if t.observe(fName, handleRead, ci, data) {
+						pktCount++
+					} else {
+						active--
+					}
+				}
+			}
+
+			for _, t := range tunneled {
+				if t.retired {
+					continue
+				}
+				if !filterTunnel(data, *t.eventFlowPair, t.event, tunnelDecoders) {
+					continue
+				}
+				if t.observe(fName, handleRead, ci, data) {
+					pktCount++
+				} else {
+					active--
+				}
+			}
+		}
+	NextFile:
+		handleRead.Close()
+		active -= retireStale(targets, lastSeen)
+	}
+
+	for _, t := range targets {
+		t.close()
+	}
+
+	logrus.Infof("Finished in %s\n", time.Since(start))
+	logrus.Infof("Written %d packet(s) across %d event(s)\n", pktCount, len(targets))
+
+	return nil
+}
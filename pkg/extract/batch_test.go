@@ -0,0 +1,115 @@
+/*
+Copyright © 2021 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package extract
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// newTestBatchTarget builds a batchTarget backed by a real temp file, so
+// close() (called by retire()) has something valid to Close().
+func newTestBatchTarget(t *testing.T, lastTimestamp time.Time) *batchTarget {
+	t.Helper()
+	outfile, err := os.CreateTemp(t.TempDir(), "batch-target-*.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &batchTarget{outfile: outfile, lastTimestamp: lastTimestamp}
+}
+
+func TestNewFlowTupleIsDirectionAgnostic(t *testing.T) {
+	forward := newFlowTuple("10.0.0.1", "10.0.0.2", 1234, 80, layers.IPProtocolTCP)
+	reverse := newFlowTuple("10.0.0.2", "10.0.0.1", 80, 1234, layers.IPProtocolTCP)
+	if forward != reverse {
+		t.Errorf("newFlowTuple(fwd) = %+v, newFlowTuple(rev) = %+v, want equal", forward, reverse)
+	}
+
+	other := newFlowTuple("10.0.0.1", "10.0.0.3", 1234, 80, layers.IPProtocolTCP)
+	if forward == other {
+		t.Errorf("tuples for different destination IPs compared equal: %+v", forward)
+	}
+}
+
+func TestProtoFromName(t *testing.T) {
+	cases := map[string]layers.IPProtocol{
+		"TCP":     layers.IPProtocolTCP,
+		"tcp":     layers.IPProtocolTCP,
+		"UDP":     layers.IPProtocolUDP,
+		"ICMP":    layers.IPProtocolICMPv4,
+		"unknown": 0,
+	}
+	for name, want := range cases {
+		if got := protoFromName(name); got != want {
+			t.Errorf("protoFromName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestDecodeFlowTuple(t *testing.T) {
+	data := buildTestTCPPacket(t, "10.0.0.1", "10.0.0.2", 1234, 80)
+	tuple, ok := decodeFlowTuple(data)
+	if !ok {
+		t.Fatal("decodeFlowTuple() = false, want true for a plain TCP/IP packet")
+	}
+	want := newFlowTuple("10.0.0.1", "10.0.0.2", 1234, 80, layers.IPProtocolTCP)
+	if tuple != want {
+		t.Errorf("decodeFlowTuple() = %+v, want %+v", tuple, want)
+	}
+}
+
+func TestDecodeFlowTupleNoTransportLayer(t *testing.T) {
+	data := buildTestGREPacket(t, "10.0.0.1", "10.0.0.2", "192.168.1.1", "192.168.1.2", 4444, 80)
+	if _, ok := decodeFlowTuple(data); ok {
+		t.Error("decodeFlowTuple() = true for a GRE packet with no TCP/UDP layer at the outer level, want false")
+	}
+}
+
+// TestRetireStale checks that a flow whose own tuple will never come up
+// again (because traffic for it has genuinely stopped) still retires once
+// a later packet, for some unrelated flow, is read past its FlowTimeout -
+// not just when a packet matching that flow's own tuple happens to arrive.
+func TestRetireStale(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+
+	stale := newTestBatchTarget(t, base)
+	fresh := newTestBatchTarget(t, base.Add(FlowTimeout/2))
+	neverMatched := newTestBatchTarget(t, time.Time{})
+	alreadyRetired := newTestBatchTarget(t, base)
+	alreadyRetired.retired = true
+	alreadyRetired.closed = true
+
+	lastSeen := base.Add(FlowTimeout + time.Second)
+	targets := []*batchTarget{stale, fresh, neverMatched, alreadyRetired}
+
+	got := retireStale(targets, lastSeen)
+	if got != 1 {
+		t.Errorf("retireStale() retired %d targets, want 1", got)
+	}
+	if !stale.retired {
+		t.Error("target past FlowTimeout was not retired")
+	}
+	if fresh.retired {
+		t.Error("target within FlowTimeout was retired")
+	}
+	if neverMatched.retired {
+		t.Error("target that never matched a packet was retired")
+	}
+}
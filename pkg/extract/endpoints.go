@@ -0,0 +1,47 @@
+/*
+Copyright © 2021 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package extract
+
+import (
+	"errors"
+	"net"
+)
+
+// EndpointPair is the 5-tuple of a flow, with A and B holding the event's
+// source and destination as recorded. It is used instead of the raw Event
+// fields so matching code can compare a packet against a flow; matchEndpoints
+// accepts the packet in either direction.
+type EndpointPair struct {
+	IPA, IPB     net.IP
+	PortA, PortB uint16
+	Proto        string
+}
+
+// buildEndpoints derives the EndpointPair that identifies event's flow on
+// the wire.
+func buildEndpoints(event Event) (*EndpointPair, error) {
+	if event.SrcIP.IP == nil || event.DestIP.IP == nil {
+		return nil, errors.New("Event is missing src_ip/dest_ip")
+	}
+	return &EndpointPair{
+		IPA:   event.SrcIP.IP,
+		IPB:   event.DestIP.IP,
+		PortA: event.SrcPort,
+		PortB: event.DestPort,
+		Proto: event.Proto,
+	}, nil
+}
@@ -72,8 +72,15 @@ type Tunnel struct {
 	Depth    uint8  `json:"depth"`
 }
 
+// Alert is the subset of Suricata's "alert" EVE object used to match events
+// against a watched list of signature IDs.
+type Alert struct {
+	SignatureID uint64 `json:"signature_id"`
+}
+
 type Event struct {
 	Timestamp   string
+	FlowID      uint64 `json:"flow_id"`
 	CaptureFile string `json:"capture_file"`
 	SrcIP       IPAddr `json:"src_ip"`
 	DestIP      IPAddr `json:"dest_ip"`
@@ -82,6 +89,7 @@ type Event struct {
 	AppProto    string `json:"app_proto"`
 	Proto       string `json:"proto"`
 	Tunnel      Tunnel `json:"tunnel"`
+	Alert       Alert  `json:"alert"`
 }
 
 func openPcapReaderHandle(fName string, bpfFilter string) (*pcap.Handle, error) {
@@ -108,6 +116,119 @@ type ExtractPcapConfig struct {
 	EventPath        string
 	FileFormat       string
 	SkipBpf          bool
+
+	// Interface is the NIC to capture from when Live is true.
+	Interface string
+	// Live switches extraction from walking PcapLogDirectory to capturing
+	// straight off Interface. It only applies when the event carries no
+	// CaptureFile.
+	Live bool
+	// SnapLen is the inactive handle snapshot length used in Live mode.
+	// Defaults to 65536 when zero.
+	SnapLen int
+	// Promisc puts Interface in promiscuous mode in Live mode.
+	Promisc bool
+	// Timeout is the inactive handle read timeout used in Live mode.
+	// Defaults to time.Second when zero.
+	Timeout time.Duration
+	// TimestampSource is the preferred timestamp source name, taken from
+	// pcap.Handle.SupportedTimestamps(), e.g. "adapter_unsynced". If empty,
+	// or not supported by Interface, the first supported source is used.
+	TimestampSource string
+
+	// TunnelDecoders maps nonstandard UDP ports to the overlay protocol
+	// decoded there, as "name:port" (e.g. "vxlan:4789", "geneve:6081").
+	// VXLAN on 4789 and Geneve on 6081 are always recognized even if not
+	// listed here.
+	TunnelDecoders []string
+
+	// OutputFormat selects the output file format. The zero value writes a
+	// classic pcapgo.Writer file; "pcapng" writes pcap-ng instead, with one
+	// Interface Description Block per source pcap file and a per-packet
+	// comment carrying the matching event's metadata.
+	OutputFormat string
+
+	// HandleCache, if set, is used instead of opening pcap files directly,
+	// so that a burst of jobs sharing it (see Watcher) don't all pay to
+	// reopen and re-filter the same rotating pcap file.
+	HandleCache *HandleCache
+}
+
+// getPcapReaderHandle opens fName filtered by bpfFilter, going through
+// config.HandleCache when one is set. It returns the handle along with a
+// release func the caller must invoke once done reading, passing whether
+// the handle reached EOF.
+func getPcapReaderHandle(config ExtractPcapConfig, fName, bpfFilter string) (*pcap.Handle, func(exhausted bool), error) {
+	if config.HandleCache == nil {
+		handle, err := openPcapReaderHandle(fName, bpfFilter)
+		closed := false
+		return handle, func(bool) {
+			if !closed {
+				closed = true
+				handle.Close()
+			}
+		}, err
+	}
+
+	handle, err := config.HandleCache.Get(fName, bpfFilter)
+	if err != nil {
+		return nil, func(bool) {}, err
+	}
+	released := false
+	return handle, func(exhausted bool) {
+		if !released {
+			released = true
+			config.HandleCache.Release(fName, bpfFilter, handle, exhausted)
+		}
+	}, nil
+}
+
+// openLiveHandle configures and activates an inactive pcap handle on
+// config.Interface, preferring config.TimestampSource among the values
+// reported by SupportedTimestamps() and falling back to the first one
+// available.
+func openLiveHandle(config ExtractPcapConfig) (*pcap.Handle, error) {
+	snapLen := config.SnapLen
+	if snapLen == 0 {
+		snapLen = 65536
+	}
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = time.Second
+	}
+
+	inactive, err := pcap.NewInactiveHandle(config.Interface)
+	if err != nil {
+		return nil, err
+	}
+	defer inactive.CleanUp()
+
+	if err := inactive.SetSnapLen(snapLen); err != nil {
+		return nil, err
+	}
+	if err := inactive.SetPromisc(config.Promisc); err != nil {
+		return nil, err
+	}
+	if err := inactive.SetTimeout(timeout); err != nil {
+		return nil, err
+	}
+
+	if sources := inactive.SupportedTimestamps(); len(sources) > 0 {
+		tstype := sources[0]
+		if config.TimestampSource != "" {
+			for _, t := range sources {
+				if t.String() == config.TimestampSource {
+					tstype = t
+					break
+				}
+			}
+		}
+		if err := inactive.SetTimestampSource(tstype); err != nil {
+			return nil, err
+		}
+	}
+
+	return inactive.Activate()
 }
 
 /*
@@ -150,11 +271,6 @@ func ExtractPcapFile(config ExtractPcapConfig) error {
 		return err
 	}
 
-	pcapFileList := NewPcapFileList(config.PcapLogDirectory, event, config.FileFormat)
-	if pcapFileList == nil {
-		return errors.New("Problem when building pcap file list")
-	}
-
 	bpfFilter := ""
 	if config.SkipBpf != true {
 		bpfFilter, err = buildBPF(event)
@@ -163,6 +279,11 @@ func ExtractPcapFile(config ExtractPcapConfig) error {
 		}
 	}
 
+	tunnelDecoders, err := newTunnelDecoders(config.TunnelDecoders)
+	if err != nil {
+		return err
+	}
+
 	// Open up a second pcap handle for packet writes.
 	outfile, err := os.Create(config.OutputName)
 	if err != nil {
@@ -171,11 +292,73 @@ func ExtractPcapFile(config ExtractPcapConfig) error {
 	}
 	defer outfile.Close()
 
-	handleWrite := pcapgo.NewWriter(outfile)
-	handleWrite.WriteFileHeader(65536, layers.LinkTypeEthernet) // new file, must do this.
-	if err != nil {
-		logrus.Error("Can't write to output file: ", err)
-		return err
+	var handleWrite *pcapgo.Writer
+	var ngWrite *ngOutput
+	if config.OutputFormat == "pcapng" {
+		ngWrite, err = newNgOutput(outfile)
+		if err != nil {
+			logrus.Error("Can't write to output file: ", err)
+			return err
+		}
+		defer ngWrite.flush()
+	} else {
+		handleWrite = pcapgo.NewWriter(outfile)
+		if err := handleWrite.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+			logrus.Error("Can't write to output file: ", err)
+			return err
+		}
+	}
+
+	if config.Live && len(event.CaptureFile) == 0 {
+		handleRead, err := openLiveHandle(config)
+		if err != nil {
+			logrus.Error("Can't open live capture handle: ", err)
+			return err
+		}
+		defer handleRead.Close()
+
+		if bpfFilter != "" {
+			if err := handleRead.SetBPFFilter(bpfFilter); err != nil {
+				logrus.Errorf("Invalid BPF Filter: %s", err)
+				return err
+			}
+		}
+
+		start := time.Now()
+		var pktCount uint64 = 0
+		var lastMatch time.Time = time.Now()
+
+		for time.Since(lastMatch) < FlowTimeout {
+			data, ci, err := handleRead.ReadPacketData()
+			switch {
+			case err == pcap.NextErrorTimeoutExpired:
+				continue
+			case err != nil:
+				logrus.Warningf("Failed to read packet %d: %s\n", pktCount, err)
+			default:
+				if config.SkipBpf == true || event.Tunnel.Depth > 0 {
+					if !filterTunnel(data, *eventFlowPair, event, tunnelDecoders) {
+						continue
+					}
+				}
+				if ngWrite != nil {
+					ngWrite.writePacket(config.Interface, handleRead, ci, data, event)
+				} else {
+					handleWrite.WritePacket(ci, data)
+				}
+				pktCount++
+				lastMatch = ci.Timestamp
+			}
+		}
+
+		logrus.Infof("Finished in %s\n", time.Since(start))
+		logrus.Infof("Written %d packet(s)\n", pktCount)
+		return nil
+	}
+
+	pcapFileList := NewPcapFileList(config.PcapLogDirectory, event, config.FileFormat)
+	if pcapFileList == nil {
+		return errors.New("Problem when building pcap file list")
 	}
 
 	start := time.Now()
@@ -202,8 +385,8 @@ func ExtractPcapFile(config ExtractPcapConfig) error {
 	for len(event.CaptureFile) == 0 || firstTimestamp.Before(lastTimestamp.Add(FlowTimeout)) {
 		filePkt := 0
 		logrus.Debugf("Reading packets from %s", fName)
-		handleRead, err := openPcapReaderHandle(fName, bpfFilter)
-		defer handleRead.Close()
+		handleRead, releaseRead, err := getPcapReaderHandle(config, fName, bpfFilter)
+		defer releaseRead(false)
 		if err != nil {
 			logrus.Warningln("This was fast")
 			break
@@ -216,18 +399,27 @@ func ExtractPcapFile(config ExtractPcapConfig) error {
 			switch {
 			case err == io.EOF:
 				logrus.Debugf("Extracted %d packet(s) from pcap file %s", filePkt, fName)
+				releaseRead(true)
 				goto NextFile
 			case err != nil:
 				logrus.Warningf("Failed to read packet %d: %s\n", pktCount, err)
 			default:
 				if config.SkipBpf == true || event.Tunnel.Depth > 0 {
-					if filterTunnel(data, *eventFlowPair, event) {
-						handleWrite.WritePacket(ci, data)
+					if filterTunnel(data, *eventFlowPair, event, tunnelDecoders) {
+						if ngWrite != nil {
+							ngWrite.writePacket(fName, handleRead, ci, data, event)
+						} else {
+							handleWrite.WritePacket(ci, data)
+						}
 						pktCount++
 						lastTimestamp = ci.Timestamp
 					}
 				} else {
-					handleWrite.WritePacket(ci, data)
+					if ngWrite != nil {
+						ngWrite.writePacket(fName, handleRead, ci, data, event)
+					} else {
+						handleWrite.WritePacket(ci, data)
+					}
 					pktCount++
 					filePkt++
 				}
@@ -240,13 +432,13 @@ func ExtractPcapFile(config ExtractPcapConfig) error {
 			logrus.Debugln(err)
 			break
 		}
-		handleTest, err := openPcapReaderHandle(fName, bpfFilter)
+		_, releaseTest, err := getPcapReaderHandle(config, fName, bpfFilter)
 		if err != nil {
 			break
 		}
 		_, ci, err := handleRead.ReadPacketData()
 		firstTimestamp = ci.Timestamp
-		handleTest.Close()
+		releaseTest(false)
 	}
 	logrus.Infof("Finished in %s\n", time.Since(start))
 	logrus.Infof("Written %d packet(s)\n", pktCount)
@@ -0,0 +1,172 @@
+/*
+Copyright © 2021 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package extract
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// handleCacheKey identifies a pcap file opened with a particular BPF
+// filter; a cached handle can only be handed back out under the exact same
+// filter it was opened with.
+type handleCacheKey struct {
+	fName string
+	bpf   string
+}
+
+type cachedHandle struct {
+	handle   *pcap.Handle
+	inUse    bool
+	lastUsed time.Time
+}
+
+/*
+HandleCache deduplicates opens of the same (file, BPF filter) pair when a
+burst of events arriving within a few seconds route through the same
+rotating pcap file - common right after Suricata rotates, when many alerts
+still point at the file that just closed. A pcap.Handle only reads forward,
+so it can only ever be lent out to one caller at a time; concurrent
+requests for the same key each get their own handle, tracked side by side,
+so correctness never depends on the cache hitting.
+
+The zero value is not usable; construct with NewHandleCache. Call Close
+when done with it.
+*/
+type HandleCache struct {
+	mu      sync.Mutex
+	entries map[handleCacheKey][]*cachedHandle
+	ttl     time.Duration
+	stop    chan struct{}
+}
+
+// NewHandleCache starts a HandleCache that closes handles idle for longer
+// than ttl. A ttl of zero uses a 30 second default.
+func NewHandleCache(ttl time.Duration) *HandleCache {
+	if ttl <= 0 {
+		ttl = 30 * time.Second
+	}
+	c := &HandleCache{
+		entries: make(map[handleCacheKey][]*cachedHandle),
+		ttl:     ttl,
+		stop:    make(chan struct{}),
+	}
+	go c.reap()
+	return c
+}
+
+// Get returns a handle for fName filtered by bpfFilter: a cached one that's
+// not currently checked out if there is one, otherwise a freshly opened one
+// recorded alongside any others already in flight for the same key.
+// Callers must call Release with the returned handle once done reading,
+// which either returns it to the cache for reuse or closes it if it
+// reached EOF.
+func (c *HandleCache) Get(fName, bpfFilter string) (*pcap.Handle, error) {
+	key := handleCacheKey{fName: fName, bpf: bpfFilter}
+
+	c.mu.Lock()
+	for _, entry := range c.entries[key] {
+		if !entry.inUse {
+			entry.inUse = true
+			entry.lastUsed = time.Now()
+			c.mu.Unlock()
+			return entry.handle, nil
+		}
+	}
+	c.mu.Unlock()
+
+	handle, err := openPcapReaderHandle(fName, bpfFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.entries[key] = append(c.entries[key], &cachedHandle{handle: handle, inUse: true, lastUsed: time.Now()})
+	c.mu.Unlock()
+	return handle, nil
+}
+
+// Release marks handle, previously returned by Get(fName, bpfFilter), as
+// available again. Pass exhausted=true once the handle has returned
+// io.EOF, since it can't be rewound and reuse would be futile; exhausted
+// handles are closed and dropped immediately instead of waiting for the
+// reaper.
+func (c *HandleCache) Release(fName, bpfFilter string, handle *pcap.Handle, exhausted bool) {
+	key := handleCacheKey{fName: fName, bpf: bpfFilter}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := c.entries[key]
+	for i, entry := range entries {
+		if entry.handle != handle {
+			continue
+		}
+		if exhausted {
+			entry.handle.Close()
+			c.entries[key] = append(entries[:i], entries[i+1:]...)
+		} else {
+			entry.inUse = false
+			entry.lastUsed = time.Now()
+		}
+		return
+	}
+}
+
+func (c *HandleCache) reap() {
+	ticker := time.NewTicker(c.ttl)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.mu.Lock()
+			for key, entries := range c.entries {
+				live := entries[:0]
+				for _, entry := range entries {
+					if !entry.inUse && time.Since(entry.lastUsed) > c.ttl {
+						entry.handle.Close()
+						continue
+					}
+					live = append(live, entry)
+				}
+				if len(live) == 0 {
+					delete(c.entries, key)
+				} else {
+					c.entries[key] = live
+				}
+			}
+			c.mu.Unlock()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Close stops the reaper and closes every cached handle, in use or not.
+func (c *HandleCache) Close() {
+	close(c.stop)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entries := range c.entries {
+		for _, entry := range entries {
+			entry.handle.Close()
+		}
+		delete(c.entries, key)
+	}
+}
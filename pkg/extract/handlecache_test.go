@@ -0,0 +1,112 @@
+/*
+Copyright © 2021 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package extract
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeEmptyPcap writes a valid but empty pcap file (just a global header)
+// so pcap.OpenOffline succeeds against it.
+func writeEmptyPcap(t *testing.T, path string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], 65536)
+	binary.LittleEndian.PutUint32(header[20:24], 1)
+	if _, err := f.Write(header); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestHandleCacheConcurrentSameKey exercises many goroutines contending for
+// the same (file, filter) key at once: each must get its own handle rather
+// than clobbering another's still-checked-out entry, and every handle must
+// end up released (not stuck in-use, not leaked) once all goroutines finish.
+func TestHandleCacheConcurrentSameKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.pcap")
+	writeEmptyPcap(t, path)
+
+	cache := NewHandleCache(time.Minute)
+	defer cache.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handle, err := cache.Get(path, "")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			time.Sleep(time.Millisecond)
+			cache.Release(path, "", handle, false)
+		}()
+	}
+	wg.Wait()
+
+	cache.mu.Lock()
+	entries := cache.entries[handleCacheKey{fName: path, bpf: ""}]
+	cache.mu.Unlock()
+
+	if len(entries) != 8 {
+		t.Fatalf("expected 8 distinct handles tracked, got %d", len(entries))
+	}
+	for _, e := range entries {
+		if e.inUse {
+			t.Errorf("entry left marked in-use after its goroutine released it")
+		}
+	}
+}
+
+// TestHandleCacheExhaustedRemovesEntry checks that releasing a handle as
+// exhausted drops it from the cache instead of leaving a dead entry behind.
+func TestHandleCacheExhaustedRemovesEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.pcap")
+	writeEmptyPcap(t, path)
+
+	cache := NewHandleCache(time.Minute)
+	defer cache.Close()
+
+	handle, err := cache.Get(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Release(path, "", handle, true)
+
+	cache.mu.Lock()
+	entries := cache.entries[handleCacheKey{fName: path, bpf: ""}]
+	cache.mu.Unlock()
+
+	if len(entries) != 0 {
+		t.Errorf("expected exhausted handle to be dropped, got %d entries", len(entries))
+	}
+}
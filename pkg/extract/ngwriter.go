@@ -0,0 +1,109 @@
+/*
+Copyright © 2021 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package extract
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// ngOutput wraps a pcapgo.NgWriter to add one Interface Description Block
+// per distinct source pcap file, and a compact JSON comment on every packet
+// describing the event that matched it. It is used instead of plain
+// pcapgo.Writer when ExtractPcapConfig.OutputFormat is "pcapng".
+type ngOutput struct {
+	writer     *pcapgo.NgWriter
+	interfaces map[string]int
+}
+
+func newNgOutput(out io.Writer) (*ngOutput, error) {
+	writer, err := pcapgo.NewNgWriter(out, gopacket.LinkTypeEthernet)
+	if err != nil {
+		return nil, err
+	}
+	return &ngOutput{writer: writer, interfaces: make(map[string]int)}, nil
+}
+
+// interfaceFor returns the pcap-ng interface id for fName, writing a new
+// Interface Description Block the first time fName is seen and copying its
+// link type and snap length from handle.
+func (n *ngOutput) interfaceFor(fName string, handle *pcap.Handle) (int, error) {
+	if id, ok := n.interfaces[fName]; ok {
+		return id, nil
+	}
+
+	id, err := n.writer.WriteInterfaceDescription(pcapgo.NgInterface{
+		Name:        fName,
+		Description: fName,
+		LinkType:    handle.LinkType(),
+		SnapLength:  uint32(handle.SnapLen()),
+	})
+	if err != nil {
+		return 0, err
+	}
+	n.interfaces[fName] = id
+	return id, nil
+}
+
+// packetComment is the JSON blob attached to every written packet,
+// identifying the EVE event fields that caused it to match.
+type packetComment struct {
+	FlowID      uint64 `json:"flow_id,omitempty"`
+	AppProto    string `json:"app_proto,omitempty"`
+	SrcIP       string `json:"src_ip,omitempty"`
+	DestIP      string `json:"dest_ip,omitempty"`
+	TunnelDepth uint8  `json:"tunnel_depth,omitempty"`
+}
+
+// eventComment renders event as the JSON comment attached to packets
+// written for it.
+func eventComment(event Event) string {
+	comment := packetComment{
+		FlowID:      event.FlowID,
+		AppProto:    event.AppProto,
+		SrcIP:       event.SrcIP.String(),
+		DestIP:      event.DestIP.String(),
+		TunnelDepth: event.Tunnel.Depth,
+	}
+	blob, err := json.Marshal(comment)
+	if err != nil {
+		return ""
+	}
+	return string(blob)
+}
+
+// writePacket writes data, read from fName via handle, as a packet
+// belonging to event, tagging it with the source interface and a comment
+// describing event.
+func (n *ngOutput) writePacket(fName string, handle *pcap.Handle, ci gopacket.CaptureInfo, data []byte, event Event) error {
+	ifaceID, err := n.interfaceFor(fName, handle)
+	if err != nil {
+		return err
+	}
+	ci.InterfaceIndex = ifaceID
+	return n.writer.WritePacketWithOptions(ci, data, pcapgo.NgPacketOptions{
+		Comment: eventComment(event),
+	})
+}
+
+func (n *ngOutput) flush() error {
+	return n.writer.Flush()
+}
@@ -0,0 +1,257 @@
+/*
+Copyright © 2021 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package extract
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	greProtoERSPANII  = 0x88be
+	greProtoERSPANIII = 0x22eb
+)
+
+// tunnelDecoders maps a UDP destination port to the overlay protocol
+// expected there, built from ExtractPcapConfig.TunnelDecoders entries like
+// "vxlan:4789" or "geneve:6081". It ships with the IANA-assigned ports for
+// both as defaults, so TunnelDecoders is only needed to add nonstandard
+// ports.
+type tunnelDecoders map[uint16]string
+
+func newTunnelDecoders(specs []string) (tunnelDecoders, error) {
+	decoders := tunnelDecoders{
+		4789: "vxlan",
+		6081: "geneve",
+	}
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid tunnel decoder %q, want \"name:port\"", spec)
+		}
+		port, err := strconv.ParseUint(parts[1], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid tunnel decoder port in %q: %s", spec, err)
+		}
+		decoders[uint16(port)] = parts[0]
+	}
+	return decoders, nil
+}
+
+/*
+filterTunnel decides whether a raw packet belongs to event's flow.
+
+When event.Tunnel.Depth is zero, this is a plain 5-tuple comparison of the
+packet against eventFlowPair. Otherwise the packet's outermost tuple is
+compared against event.Tunnel, and the packet is then decapsulated one
+level at a time - GRE, VXLAN, Geneve, ERSPAN Type II/III, IP-in-IP and
+MPLS-over-GRE are all recognized - re-entering the parser on the inner
+payload.
+Packets whose outer tuple matches event.Tunnel but that don't carry enough
+encapsulation to reach the requested Depth are dropped, since BPF cannot
+express "inner tuple over VXLAN" and this is the only place that
+distinction can be made. The tuple found at exactly Depth levels in is what
+gets compared against eventFlowPair.
+*/
+func filterTunnel(data []byte, eventFlowPair EndpointPair, event Event, decoders tunnelDecoders) bool {
+	packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+
+	if event.Tunnel.Depth == 0 {
+		return matchEndpoints(packet, eventFlowPair)
+	}
+
+	if !matchesTunnelEndpoints(packet, event.Tunnel) {
+		return false
+	}
+
+	cur := packet
+	for depth := uint8(0); depth < event.Tunnel.Depth; depth++ {
+		payload, linkType, ok := decapsulate(cur, decoders)
+		if !ok {
+			return false
+		}
+		cur = gopacket.NewPacket(payload, linkType, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	}
+
+	return matchEndpoints(cur, eventFlowPair)
+}
+
+// matchEndpoints compares packet's network/transport 5-tuple against pair,
+// in either direction.
+func matchEndpoints(packet gopacket.Packet, pair EndpointPair) bool {
+	netLayer := packet.NetworkLayer()
+	if netLayer == nil {
+		return false
+	}
+	src, dst := netLayer.NetworkFlow().Endpoints()
+
+	srcPort, dstPort, ok := transportPorts(packet)
+	if !ok {
+		return false
+	}
+
+	a, b := pair.IPA.String(), pair.IPB.String()
+	if src.String() == a && dst.String() == b && srcPort == pair.PortA && dstPort == pair.PortB {
+		return true
+	}
+	if src.String() == b && dst.String() == a && srcPort == pair.PortB && dstPort == pair.PortA {
+		return true
+	}
+	return false
+}
+
+// matchesTunnelEndpoints compares packet's outer network/transport 5-tuple
+// against the src/dst recorded on tunnel, in either direction.
+func matchesTunnelEndpoints(packet gopacket.Packet, tunnel Tunnel) bool {
+	netLayer := packet.NetworkLayer()
+	if netLayer == nil || tunnel.SrcIP.IP == nil || tunnel.DestIP.IP == nil {
+		return false
+	}
+	src, dst := netLayer.NetworkFlow().Endpoints()
+
+	srcPort, dstPort, ok := outerTransportPorts(packet)
+	if !ok {
+		// Tunnels such as IP-in-IP have no transport header of their own.
+		return (src.String() == tunnel.SrcIP.String() && dst.String() == tunnel.DestIP.String()) ||
+			(src.String() == tunnel.DestIP.String() && dst.String() == tunnel.SrcIP.String())
+	}
+
+	a, b := tunnel.SrcIP.String(), tunnel.DestIP.String()
+	if src.String() == a && dst.String() == b && srcPort == tunnel.SrcPort && dstPort == tunnel.DestPort {
+		return true
+	}
+	if src.String() == b && dst.String() == a && srcPort == tunnel.DestPort && dstPort == tunnel.SrcPort {
+		return true
+	}
+	return false
+}
+
+func transportPorts(packet gopacket.Packet) (uint16, uint16, bool) {
+	switch t := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		return uint16(t.SrcPort), uint16(t.DstPort), true
+	case *layers.UDP:
+		return uint16(t.SrcPort), uint16(t.DstPort), true
+	default:
+		return 0, 0, false
+	}
+}
+
+// outerTransportPorts is transportPorts restricted to a TCP/UDP header
+// carried directly by packet's outermost network layer. gopacket's
+// TransportLayer() returns the first one decoded anywhere in the packet,
+// which for GRE, IP-in-IP or MPLS is the encapsulated packet's.
+func outerTransportPorts(packet gopacket.Packet) (uint16, uint16, bool) {
+	networks := 0
+	for _, l := range packet.Layers() {
+		if _, ok := l.(gopacket.TransportLayer); ok {
+			break
+		}
+		if _, ok := l.(gopacket.NetworkLayer); ok {
+			networks++
+		}
+	}
+	if networks > 1 {
+		return 0, 0, false
+	}
+	return transportPorts(packet)
+}
+
+// decapsulate strips one level of tunnel encapsulation from packet,
+// returning the inner payload and the gopacket layer type it should be
+// re-parsed as.
+func decapsulate(packet gopacket.Packet, decoders tunnelDecoders) ([]byte, gopacket.LayerType, bool) {
+	if greLayer := packet.Layer(layers.LayerTypeGRE); greLayer != nil {
+		gre := greLayer.(*layers.GRE)
+		switch gre.Protocol {
+		case layers.EthernetTypeMPLSUnicast:
+			return gre.LayerPayload(), layers.LayerTypeMPLS, true
+		case layers.EthernetTypeIPv4:
+			return gre.LayerPayload(), layers.LayerTypeIPv4, true
+		case layers.EthernetTypeIPv6:
+			return gre.LayerPayload(), layers.LayerTypeIPv6, true
+		case greProtoERSPANII:
+			payload := gre.LayerPayload()
+			if len(payload) < 8 {
+				return nil, 0, false
+			}
+			return payload[8:], layers.LayerTypeEthernet, true
+		case greProtoERSPANIII:
+			payload := gre.LayerPayload()
+			if len(payload) < 12 {
+				return nil, 0, false
+			}
+			return payload[12:], layers.LayerTypeEthernet, true
+		default:
+			return gre.LayerPayload(), layers.LayerTypeEthernet, true
+		}
+	}
+
+	if udp, ok := packet.TransportLayer().(*layers.UDP); ok {
+		payload := udp.LayerPayload()
+		switch decoders[uint16(udp.DstPort)] {
+		case "vxlan":
+			if len(payload) < 8 {
+				return nil, 0, false
+			}
+			return payload[8:], layers.LayerTypeEthernet, true
+		case "geneve":
+			return decapsulateGeneve(payload)
+		}
+	}
+
+	if ip4Layer := packet.Layer(layers.LayerTypeIPv4); ip4Layer != nil {
+		ip4 := ip4Layer.(*layers.IPv4)
+		if ip4.Protocol == layers.IPProtocolIPIP {
+			return ip4.LayerPayload(), layers.LayerTypeIPv4, true
+		}
+	}
+
+	return nil, 0, false
+}
+
+// decapsulateGeneve parses a Geneve header (RFC 8926): 8 fixed bytes of
+// version/options-length, flags, protocol type and VNI, followed by
+// Options-Length*4 bytes of
+// variable options, followed by the inner payload. gopacket has no built-in
+// Geneve layer, so it's parsed by hand here.
+func decapsulateGeneve(payload []byte) ([]byte, gopacket.LayerType, bool) {
+	if len(payload) < 8 {
+		return nil, 0, false
+	}
+	optLen := int(payload[0]&0x3f) * 4
+	headerLen := 8 + optLen
+	if len(payload) < headerLen {
+		return nil, 0, false
+	}
+
+	var innerType gopacket.LayerType
+	switch binary.BigEndian.Uint16(payload[2:4]) {
+	case uint16(layers.EthernetTypeIPv4):
+		innerType = layers.LayerTypeIPv4
+	case uint16(layers.EthernetTypeIPv6):
+		innerType = layers.LayerTypeIPv6
+	default:
+		innerType = layers.LayerTypeEthernet
+	}
+	return payload[headerLen:], innerType, true
+}
@@ -0,0 +1,420 @@
+/*
+Copyright © 2021 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package extract
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// buildTestTCPPacket serializes a minimal Ethernet/IPv4/TCP packet between
+// the given endpoints, for tests that need real packet bytes to decode.
+func buildTestTCPPacket(t *testing.T, srcIP, dstIP string, srcPort, dstPort uint16) []byte {
+	t.Helper()
+	eth := &layers.Ethernet{EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.ParseIP(srcIP).To4(),
+		DstIP:    net.ParseIP(dstIP).To4(),
+	}
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(srcPort), DstPort: layers.TCPPort(dstPort)}
+	if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, tcp, gopacket.Payload("payload")); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// buildTestGREPacket serializes a minimal Ethernet/IPv4/GRE packet carrying
+// an inner IPv4/TCP packet between innerSrcIP:innerSrcPort and
+// innerDstIP:innerDstPort, for tests exercising decapsulation.
+func buildTestGREPacket(t *testing.T, outerSrcIP, outerDstIP, innerSrcIP, innerDstIP string, innerSrcPort, innerDstPort uint16) []byte {
+	t.Helper()
+	eth := &layers.Ethernet{EthernetType: layers.EthernetTypeIPv4}
+	outerIP := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolGRE,
+		SrcIP:    net.ParseIP(outerSrcIP).To4(),
+		DstIP:    net.ParseIP(outerDstIP).To4(),
+	}
+	gre := &layers.GRE{Protocol: layers.EthernetTypeIPv4}
+
+	innerIP := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.ParseIP(innerSrcIP).To4(),
+		DstIP:    net.ParseIP(innerDstIP).To4(),
+	}
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(innerSrcPort), DstPort: layers.TCPPort(innerDstPort)}
+	if err := tcp.SetNetworkLayerForChecksum(innerIP); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, outerIP, gre, innerIP, tcp, gopacket.Payload("payload")); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// buildTestVXLANPacket serializes a minimal Ethernet/IPv4/UDP packet whose
+// payload is a VXLAN header (8 bytes, contents unchecked by decapsulate)
+// followed by an inner Ethernet/IPv4/TCP frame.
+func buildTestVXLANPacket(t *testing.T, outerSrcIP, outerDstIP string, vxlanPort uint16, innerSrcIP, innerDstIP string, innerSrcPort, innerDstPort uint16) []byte {
+	t.Helper()
+	inner := buildTestTCPPacket(t, innerSrcIP, innerDstIP, innerSrcPort, innerDstPort)
+	payload := append(make([]byte, 8), inner...)
+	return buildTestUDPTunnelPacket(t, outerSrcIP, outerDstIP, vxlanPort, payload)
+}
+
+// buildTestERSPANPacket serializes a minimal Ethernet/IPv4/GRE packet whose
+// GRE payload is an ERSPAN Type II (8 byte) or Type III (12 byte) header,
+// contents unchecked by decapsulate, followed by an inner Ethernet/IPv4/TCP
+// frame.
+func buildTestERSPANPacket(t *testing.T, greProto layers.EthernetType, headerLen int, outerSrcIP, outerDstIP, innerSrcIP, innerDstIP string, innerSrcPort, innerDstPort uint16) []byte {
+	t.Helper()
+	inner := buildTestTCPPacket(t, innerSrcIP, innerDstIP, innerSrcPort, innerDstPort)
+	payload := append(make([]byte, headerLen), inner...)
+	return buildTestGREPayloadPacket(t, outerSrcIP, outerDstIP, greProto, payload)
+}
+
+// buildTestIPinIPPacket serializes a minimal Ethernet/IPv4(protocol=IPIP)
+// packet directly carrying an inner IPv4/TCP packet, with no Ethernet
+// framing of its own.
+func buildTestIPinIPPacket(t *testing.T, outerSrcIP, outerDstIP, innerSrcIP, innerDstIP string, innerSrcPort, innerDstPort uint16) []byte {
+	t.Helper()
+	eth := &layers.Ethernet{EthernetType: layers.EthernetTypeIPv4}
+	outerIP := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolIPIP,
+		SrcIP:    net.ParseIP(outerSrcIP).To4(),
+		DstIP:    net.ParseIP(outerDstIP).To4(),
+	}
+	innerIP := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.ParseIP(innerSrcIP).To4(),
+		DstIP:    net.ParseIP(innerDstIP).To4(),
+	}
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(innerSrcPort), DstPort: layers.TCPPort(innerDstPort)}
+	if err := tcp.SetNetworkLayerForChecksum(innerIP); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, outerIP, innerIP, tcp, gopacket.Payload("payload")); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// buildTestMPLSGREPacket serializes a minimal Ethernet/IPv4/GRE packet
+// carrying a single bottom-of-stack MPLS label followed directly by an
+// inner IPv4/TCP packet, the way MPLS-over-GRE is carried on the wire.
+func buildTestMPLSGREPacket(t *testing.T, outerSrcIP, outerDstIP, innerSrcIP, innerDstIP string, innerSrcPort, innerDstPort uint16) []byte {
+	t.Helper()
+	eth := &layers.Ethernet{EthernetType: layers.EthernetTypeIPv4}
+	outerIP := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolGRE,
+		SrcIP:    net.ParseIP(outerSrcIP).To4(),
+		DstIP:    net.ParseIP(outerDstIP).To4(),
+	}
+	gre := &layers.GRE{Protocol: layers.EthernetTypeMPLSUnicast}
+	mpls := &layers.MPLS{Label: 100, TTL: 64, StackBottom: true}
+
+	innerIP := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.ParseIP(innerSrcIP).To4(),
+		DstIP:    net.ParseIP(innerDstIP).To4(),
+	}
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(innerSrcPort), DstPort: layers.TCPPort(innerDstPort)}
+	if err := tcp.SetNetworkLayerForChecksum(innerIP); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, outerIP, gre, mpls, innerIP, tcp, gopacket.Payload("payload")); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// buildTestUDPTunnelPacket serializes a minimal Ethernet/IPv4/UDP packet
+// whose raw payload is exactly payload - used by tunnels like VXLAN whose
+// header decapsulate parses by hand rather than via a gopacket layer.
+func buildTestUDPTunnelPacket(t *testing.T, srcIP, dstIP string, dstPort uint16, payload []byte) []byte {
+	t.Helper()
+	eth := &layers.Ethernet{EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.ParseIP(srcIP).To4(),
+		DstIP:    net.ParseIP(dstIP).To4(),
+	}
+	udp := &layers.UDP{SrcPort: 55555, DstPort: layers.UDPPort(dstPort)}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, udp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// buildTestGREPayloadPacket serializes a minimal Ethernet/IPv4/GRE packet
+// whose raw GRE payload is exactly payload - used by tunnels like ERSPAN
+// whose header decapsulate parses by hand rather than via a gopacket layer.
+func buildTestGREPayloadPacket(t *testing.T, srcIP, dstIP string, greProto layers.EthernetType, payload []byte) []byte {
+	t.Helper()
+	eth := &layers.Ethernet{EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolGRE,
+		SrcIP:    net.ParseIP(srcIP).To4(),
+		DstIP:    net.ParseIP(dstIP).To4(),
+	}
+	gre := &layers.GRE{Protocol: greProto}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, gre, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFilterTunnelNoTunnel(t *testing.T) {
+	data := buildTestTCPPacket(t, "10.0.0.1", "10.0.0.2", 1234, 80)
+	event := Event{}
+	decoders, _ := newTunnelDecoders(nil)
+
+	match := EndpointPair{IPA: net.ParseIP("10.0.0.1"), IPB: net.ParseIP("10.0.0.2"), PortA: 1234, PortB: 80}
+	if !filterTunnel(data, match, event, decoders) {
+		t.Error("filterTunnel() = false for a packet matching the flow, want true")
+	}
+
+	mismatch := EndpointPair{IPA: net.ParseIP("10.0.0.1"), IPB: net.ParseIP("10.0.0.3"), PortA: 1234, PortB: 80}
+	if filterTunnel(data, mismatch, event, decoders) {
+		t.Error("filterTunnel() = true for a packet not matching the flow, want false")
+	}
+}
+
+func TestFilterTunnelGRE(t *testing.T) {
+	data := buildTestGREPacket(t, "198.51.100.1", "198.51.100.2", "192.168.1.1", "192.168.1.2", 4444, 80)
+	decoders, _ := newTunnelDecoders(nil)
+
+	event := Event{
+		Tunnel: Tunnel{
+			SrcIP:  IPAddr{net.ParseIP("198.51.100.1")},
+			DestIP: IPAddr{net.ParseIP("198.51.100.2")},
+			Proto:  "gre",
+			Depth:  1,
+		},
+	}
+	inner := EndpointPair{IPA: net.ParseIP("192.168.1.1"), IPB: net.ParseIP("192.168.1.2"), PortA: 4444, PortB: 80}
+	if !filterTunnel(data, inner, event, decoders) {
+		t.Error("filterTunnel() = false for a GRE packet matching tunnel and inner flow, want true")
+	}
+
+	wrongTunnel := event
+	wrongTunnel.Tunnel.SrcIP = IPAddr{net.ParseIP("203.0.113.1")}
+	if filterTunnel(data, inner, wrongTunnel, decoders) {
+		t.Error("filterTunnel() = true for a packet whose outer tuple doesn't match event.Tunnel, want false")
+	}
+
+	wrongInner := EndpointPair{IPA: net.ParseIP("192.168.1.1"), IPB: net.ParseIP("192.168.1.9"), PortA: 4444, PortB: 80}
+	if filterTunnel(data, wrongInner, event, decoders) {
+		t.Error("filterTunnel() = true for a GRE packet whose inner tuple doesn't match, want false")
+	}
+}
+
+func TestFilterTunnelVXLAN(t *testing.T) {
+	data := buildTestVXLANPacket(t, "198.51.100.1", "198.51.100.2", 4789, "192.168.1.1", "192.168.1.2", 4444, 80)
+	decoders, _ := newTunnelDecoders(nil)
+
+	event := Event{
+		Tunnel: Tunnel{
+			SrcIP:    IPAddr{net.ParseIP("198.51.100.1")},
+			DestIP:   IPAddr{net.ParseIP("198.51.100.2")},
+			SrcPort:  55555,
+			DestPort: 4789,
+			Proto:    "vxlan",
+			Depth:    1,
+		},
+	}
+	inner := EndpointPair{IPA: net.ParseIP("192.168.1.1"), IPB: net.ParseIP("192.168.1.2"), PortA: 4444, PortB: 80}
+	if !filterTunnel(data, inner, event, decoders) {
+		t.Error("filterTunnel() = false for a VXLAN packet matching tunnel and inner flow, want true")
+	}
+
+	wrongInner := EndpointPair{IPA: net.ParseIP("192.168.1.1"), IPB: net.ParseIP("192.168.1.9"), PortA: 4444, PortB: 80}
+	if filterTunnel(data, wrongInner, event, decoders) {
+		t.Error("filterTunnel() = true for a VXLAN packet whose inner tuple doesn't match, want false")
+	}
+}
+
+func TestFilterTunnelERSPANII(t *testing.T) {
+	data := buildTestERSPANPacket(t, greProtoERSPANII, 8, "198.51.100.1", "198.51.100.2", "192.168.1.1", "192.168.1.2", 4444, 80)
+	decoders, _ := newTunnelDecoders(nil)
+
+	event := Event{
+		Tunnel: Tunnel{
+			SrcIP:  IPAddr{net.ParseIP("198.51.100.1")},
+			DestIP: IPAddr{net.ParseIP("198.51.100.2")},
+			Proto:  "erspan2",
+			Depth:  1,
+		},
+	}
+	inner := EndpointPair{IPA: net.ParseIP("192.168.1.1"), IPB: net.ParseIP("192.168.1.2"), PortA: 4444, PortB: 80}
+	if !filterTunnel(data, inner, event, decoders) {
+		t.Error("filterTunnel() = false for an ERSPAN Type II packet matching tunnel and inner flow, want true")
+	}
+
+	wrongInner := EndpointPair{IPA: net.ParseIP("192.168.1.1"), IPB: net.ParseIP("192.168.1.9"), PortA: 4444, PortB: 80}
+	if filterTunnel(data, wrongInner, event, decoders) {
+		t.Error("filterTunnel() = true for an ERSPAN Type II packet whose inner tuple doesn't match, want false")
+	}
+}
+
+func TestFilterTunnelERSPANIII(t *testing.T) {
+	data := buildTestERSPANPacket(t, greProtoERSPANIII, 12, "198.51.100.1", "198.51.100.2", "192.168.1.1", "192.168.1.2", 4444, 80)
+	decoders, _ := newTunnelDecoders(nil)
+
+	event := Event{
+		Tunnel: Tunnel{
+			SrcIP:  IPAddr{net.ParseIP("198.51.100.1")},
+			DestIP: IPAddr{net.ParseIP("198.51.100.2")},
+			Proto:  "erspan3",
+			Depth:  1,
+		},
+	}
+	inner := EndpointPair{IPA: net.ParseIP("192.168.1.1"), IPB: net.ParseIP("192.168.1.2"), PortA: 4444, PortB: 80}
+	if !filterTunnel(data, inner, event, decoders) {
+		t.Error("filterTunnel() = false for an ERSPAN Type III packet matching tunnel and inner flow, want true")
+	}
+
+	wrongInner := EndpointPair{IPA: net.ParseIP("192.168.1.1"), IPB: net.ParseIP("192.168.1.9"), PortA: 4444, PortB: 80}
+	if filterTunnel(data, wrongInner, event, decoders) {
+		t.Error("filterTunnel() = true for an ERSPAN Type III packet whose inner tuple doesn't match, want false")
+	}
+}
+
+func TestFilterTunnelIPinIP(t *testing.T) {
+	data := buildTestIPinIPPacket(t, "198.51.100.1", "198.51.100.2", "192.168.1.1", "192.168.1.2", 4444, 80)
+	decoders, _ := newTunnelDecoders(nil)
+
+	event := Event{
+		Tunnel: Tunnel{
+			SrcIP:  IPAddr{net.ParseIP("198.51.100.1")},
+			DestIP: IPAddr{net.ParseIP("198.51.100.2")},
+			Proto:  "ipip",
+			Depth:  1,
+		},
+	}
+	inner := EndpointPair{IPA: net.ParseIP("192.168.1.1"), IPB: net.ParseIP("192.168.1.2"), PortA: 4444, PortB: 80}
+	if !filterTunnel(data, inner, event, decoders) {
+		t.Error("filterTunnel() = false for an IP-in-IP packet matching tunnel and inner flow, want true")
+	}
+
+	wrongInner := EndpointPair{IPA: net.ParseIP("192.168.1.1"), IPB: net.ParseIP("192.168.1.9"), PortA: 4444, PortB: 80}
+	if filterTunnel(data, wrongInner, event, decoders) {
+		t.Error("filterTunnel() = true for an IP-in-IP packet whose inner tuple doesn't match, want false")
+	}
+}
+
+func TestFilterTunnelMPLSOverGRE(t *testing.T) {
+	data := buildTestMPLSGREPacket(t, "198.51.100.1", "198.51.100.2", "192.168.1.1", "192.168.1.2", 4444, 80)
+	decoders, _ := newTunnelDecoders(nil)
+
+	event := Event{
+		Tunnel: Tunnel{
+			SrcIP:  IPAddr{net.ParseIP("198.51.100.1")},
+			DestIP: IPAddr{net.ParseIP("198.51.100.2")},
+			Proto:  "mpls",
+			Depth:  1,
+		},
+	}
+	inner := EndpointPair{IPA: net.ParseIP("192.168.1.1"), IPB: net.ParseIP("192.168.1.2"), PortA: 4444, PortB: 80}
+	if !filterTunnel(data, inner, event, decoders) {
+		t.Error("filterTunnel() = false for an MPLS-over-GRE packet matching tunnel and inner flow, want true")
+	}
+
+	wrongInner := EndpointPair{IPA: net.ParseIP("192.168.1.1"), IPB: net.ParseIP("192.168.1.9"), PortA: 4444, PortB: 80}
+	if filterTunnel(data, wrongInner, event, decoders) {
+		t.Error("filterTunnel() = true for an MPLS-over-GRE packet whose inner tuple doesn't match, want false")
+	}
+}
+
+func TestDecapsulateGeneve(t *testing.T) {
+	payload := make([]byte, 8+len("inner"))
+	payload[0] = 0 // no options
+	binary.BigEndian.PutUint16(payload[2:4], uint16(layers.EthernetTypeIPv4))
+	copy(payload[8:], "inner")
+
+	inner, linkType, ok := decapsulateGeneve(payload)
+	if !ok {
+		t.Fatal("decapsulateGeneve() = false, want true")
+	}
+	if linkType != layers.LayerTypeIPv4 {
+		t.Errorf("decapsulateGeneve() linkType = %v, want %v", linkType, layers.LayerTypeIPv4)
+	}
+	if string(inner) != "inner" {
+		t.Errorf("decapsulateGeneve() payload = %q, want %q", inner, "inner")
+	}
+}
+
+func TestDecapsulateGeneveTruncated(t *testing.T) {
+	if _, _, ok := decapsulateGeneve([]byte{0, 0, 0}); ok {
+		t.Error("decapsulateGeneve() = true for a header shorter than the fixed 8 bytes, want false")
+	}
+}
@@ -0,0 +1,411 @@
+/*
+Copyright © 2021 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package extract
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Predicate decides whether event, alongside its raw decoded JSON (for
+// matching fields Event doesn't surface), should trigger an extraction.
+type Predicate func(event Event, raw map[string]interface{}) bool
+
+// MatchAppProto builds a Predicate that matches events whose AppProto is
+// one of protos.
+func MatchAppProto(protos ...string) Predicate {
+	set := make(map[string]struct{}, len(protos))
+	for _, p := range protos {
+		set[p] = struct{}{}
+	}
+	return func(event Event, raw map[string]interface{}) bool {
+		_, ok := set[event.AppProto]
+		return ok
+	}
+}
+
+// MatchSignatureID builds a Predicate that matches alert events whose
+// alert.signature_id is one of ids.
+func MatchSignatureID(ids ...uint64) Predicate {
+	set := make(map[uint64]struct{}, len(ids))
+	for _, id := range ids {
+		set[id] = struct{}{}
+	}
+	return func(event Event, raw map[string]interface{}) bool {
+		_, ok := set[event.Alert.SignatureID]
+		return ok
+	}
+}
+
+// MatchExpression builds a Predicate from a small dotted-path equality
+// expression over the event's raw JSON, e.g. "alert.signature_id=2001219"
+// or "dns.rrname=example.com". It's intentionally not a full CEL/JMESPath
+// implementation, just enough to pick events out of an EVE stream without
+// a Go-side field for every case MatchAppProto/MatchSignatureID don't cover.
+func MatchExpression(expr string) Predicate {
+	path, want, ok := strings.Cut(expr, "=")
+	if !ok {
+		logrus.Errorf("Invalid match expression %q, want \"path=value\"", expr)
+		return func(Event, map[string]interface{}) bool { return false }
+	}
+	keys := strings.Split(path, ".")
+
+	return func(event Event, raw map[string]interface{}) bool {
+		var cur interface{} = raw
+		for _, key := range keys {
+			m, ok := cur.(map[string]interface{})
+			if !ok {
+				return false
+			}
+			cur, ok = m[key]
+			if !ok {
+				return false
+			}
+		}
+		switch v := cur.(type) {
+		case string:
+			return v == want
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64) == want
+		case bool:
+			return strconv.FormatBool(v) == want
+		default:
+			return false
+		}
+	}
+}
+
+// WatcherStats is a snapshot of a Watcher's progress, returned by Stats().
+type WatcherStats struct {
+	Processed  uint64
+	Dropped    uint64
+	AvgLatency time.Duration
+}
+
+// WatcherConfig configures a Watcher.
+type WatcherConfig struct {
+	// Extract is the base config used for every extraction job. Its
+	// EventPath and OutputName are overridden per job.
+	Extract ExtractPcapConfig
+	// EventPath is the EVE JSON file to tail, or the Unix socket to read
+	// from when Socket is true.
+	EventPath string
+	// Socket makes EventPath a Unix socket to read newline-delimited EVE
+	// JSON from, instead of a file to tail.
+	Socket bool
+	// Match decides which events enqueue an extraction job. Required.
+	Match Predicate
+	// Workers is the size of the extraction worker pool. Defaults to 4.
+	Workers int
+	// QueueSize bounds the number of jobs buffered between the tail reader
+	// and the worker pool; once full, further matching events are dropped
+	// and counted in Stats(). Defaults to 256.
+	QueueSize int
+	// OutputTemplate names each job's output file, with "{flow_id}" and
+	// "{ts}" substituted from the triggering event. Defaults to
+	// "{flow_id}-{ts}.pcap".
+	OutputTemplate string
+}
+
+type watcherJob struct {
+	event    Event
+	raw      []byte
+	enqueued time.Time
+}
+
+/*
+Watcher tails an EVE JSON file (or reads newline-delimited EVE JSON from a
+Unix socket) and runs ExtractPcapFile for every event config.Match accepts,
+turning the one-shot extraction CLI into a daemon that can run alongside
+Suricata.
+
+Matching events are queued onto a bounded channel and drained by a pool of
+config.Workers goroutines; a job's output name is built from
+config.OutputTemplate, and all jobs share a HandleCache so a burst of
+events landing in the same rotating pcap file don't each pay to reopen and
+re-filter it.
+*/
+type Watcher struct {
+	config WatcherConfig
+
+	jobs chan watcherJob
+	stop chan struct{}
+	// workersWg tracks the extraction worker pool, drained once jobs is
+	// closed. connsWg tracks in-flight tailSocket connections, which must
+	// all finish sending (or fail to send) on jobs before it's safe to
+	// close it - otherwise a connection still reading a line when Stop is
+	// called could send on a closed channel and panic.
+	workersWg sync.WaitGroup
+	connsWg   sync.WaitGroup
+
+	// connsMu guards conns, the set of currently accepted tailSocket
+	// connections, so Stop can close them and unblock any readConn
+	// goroutine parked in scanner.Scan() with no more data coming.
+	connsMu sync.Mutex
+	conns   map[net.Conn]struct{}
+
+	cache *HandleCache
+
+	processed    uint64
+	dropped      uint64
+	latencyNanos uint64
+}
+
+// NewWatcher builds a Watcher from config. Call Run to start it.
+func NewWatcher(config WatcherConfig) *Watcher {
+	if config.Workers <= 0 {
+		config.Workers = 4
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 256
+	}
+	if config.OutputTemplate == "" {
+		config.OutputTemplate = "{flow_id}-{ts}.pcap"
+	}
+
+	return &Watcher{
+		config: config,
+		jobs:   make(chan watcherJob, config.QueueSize),
+		stop:   make(chan struct{}),
+		conns:  make(map[net.Conn]struct{}),
+		cache:  NewHandleCache(0),
+	}
+}
+
+// Run starts the worker pool and tails config.EventPath (or reads its Unix
+// socket) until Stop is called or the source is closed. It blocks until the
+// tail loop, every connection it accepted, and the worker pool have all
+// finished.
+func (w *Watcher) Run() error {
+	for i := 0; i < w.config.Workers; i++ {
+		w.workersWg.Add(1)
+		go w.worker()
+	}
+
+	var err error
+	if w.config.Socket {
+		err = w.tailSocket()
+	} else {
+		err = w.tailFile()
+	}
+
+	// Only safe to close jobs once nothing can still be sending on it -
+	// tailFile sends from this goroutine and has already returned, but
+	// tailSocket's accepted connections run on their own goroutines and
+	// may still be mid-send.
+	w.connsWg.Wait()
+	close(w.jobs)
+	w.workersWg.Wait()
+
+	return err
+}
+
+// Stop ends the tail loop and returns without waiting; Run returns once
+// queued jobs have drained. Any
+// tailSocket connection currently accepted is closed too, so a peer that
+// holds its connection open without sending more data can't block Stop
+// forever inside readConn's scanner.Scan().
+func (w *Watcher) Stop() {
+	close(w.stop)
+
+	w.connsMu.Lock()
+	for conn := range w.conns {
+		conn.Close()
+	}
+	w.connsMu.Unlock()
+}
+
+// Stats returns a point-in-time snapshot of the Watcher's progress.
+func (w *Watcher) Stats() WatcherStats {
+	processed := atomic.LoadUint64(&w.processed)
+	var avg time.Duration
+	if processed > 0 {
+		avg = time.Duration(atomic.LoadUint64(&w.latencyNanos) / processed)
+	}
+	return WatcherStats{
+		Processed:  processed,
+		Dropped:    atomic.LoadUint64(&w.dropped),
+		AvgLatency: avg,
+	}
+}
+
+// Close releases the Watcher's shared HandleCache. Call after Run returns.
+func (w *Watcher) Close() {
+	w.cache.Close()
+}
+
+func (w *Watcher) tailFile() error {
+	file, err := os.Open(w.config.EventPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		select {
+		case <-w.stop:
+			return nil
+		default:
+		}
+
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			time.Sleep(200 * time.Millisecond)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		w.handleLine(line)
+	}
+}
+
+func (w *Watcher) tailSocket() error {
+	listener, err := net.Listen("unix", w.config.EventPath)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	go func() {
+		<-w.stop
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-w.stop:
+				return nil
+			default:
+				return err
+			}
+		}
+		w.connsMu.Lock()
+		w.conns[conn] = struct{}{}
+		w.connsMu.Unlock()
+
+		w.connsWg.Add(1)
+		go w.readConn(conn)
+	}
+}
+
+func (w *Watcher) readConn(conn net.Conn) {
+	defer w.connsWg.Done()
+	defer conn.Close()
+	defer func() {
+		w.connsMu.Lock()
+		delete(w.conns, conn)
+		w.connsMu.Unlock()
+	}()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		w.handleLine(scanner.Bytes())
+	}
+}
+
+func (w *Watcher) handleLine(line []byte) {
+	line = []byte(strings.TrimSpace(string(line)))
+	if len(line) == 0 {
+		return
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(line, &raw); err != nil {
+		logrus.Warningf("Failed to parse EVE event: %s\n", err)
+		return
+	}
+
+	var event Event
+	if err := json.Unmarshal(line, &event); err != nil {
+		logrus.Warningf("Failed to parse EVE event: %s\n", err)
+		return
+	}
+
+	if !w.config.Match(event, raw) {
+		return
+	}
+
+	select {
+	case w.jobs <- watcherJob{event: event, raw: line, enqueued: time.Now()}:
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+		logrus.Warningf("Extraction queue full, dropping event for flow %d\n", event.FlowID)
+	}
+}
+
+func (w *Watcher) worker() {
+	defer w.workersWg.Done()
+	for job := range w.jobs {
+		w.runJob(job)
+	}
+}
+
+func (w *Watcher) runJob(job watcherJob) {
+	eventFile, err := os.CreateTemp("", "gophercap-event-*.json")
+	if err != nil {
+		logrus.Errorf("Can't create temp event file: %s\n", err)
+		return
+	}
+	defer os.Remove(eventFile.Name())
+
+	// The original line is written rather than a re-encoding of job.event:
+	// an event without a tunnel would re-encode tunnel.src_ip as "", which
+	// IPAddr refuses to decode.
+	if _, err := eventFile.Write(job.raw); err != nil {
+		eventFile.Close()
+		logrus.Errorf("Can't write temp event file: %s\n", err)
+		return
+	}
+	eventFile.Close()
+
+	jobConfig := w.config.Extract
+	jobConfig.EventPath = eventFile.Name()
+	jobConfig.OutputName = renderOutputTemplate(w.config.OutputTemplate, job.event)
+	jobConfig.HandleCache = w.cache
+
+	if err := ExtractPcapFile(jobConfig); err != nil {
+		logrus.Errorf("Extraction failed for flow %d: %s\n", job.event.FlowID, err)
+	}
+
+	atomic.AddUint64(&w.processed, 1)
+	atomic.AddUint64(&w.latencyNanos, uint64(time.Since(job.enqueued)))
+}
+
+func renderOutputTemplate(template string, event Event) string {
+	replacer := strings.NewReplacer(
+		"{flow_id}", strconv.FormatUint(event.FlowID, 10),
+		"{ts}", strings.ReplaceAll(event.Timestamp, ":", "."),
+	)
+	return replacer.Replace(template)
+}
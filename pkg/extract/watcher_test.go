@@ -0,0 +1,111 @@
+/*
+Copyright © 2021 Stamus Networks oss@stamus-networks.com
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package extract
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMatchExpression(t *testing.T) {
+	raw := map[string]interface{}{
+		"alert": map[string]interface{}{
+			"signature_id": float64(2001219),
+		},
+		"dns": map[string]interface{}{
+			"rrname": "example.com",
+		},
+	}
+
+	cases := []struct {
+		name  string
+		expr  string
+		event Event
+		want  bool
+	}{
+		{"matching nested number", "alert.signature_id=2001219", Event{}, true},
+		{"mismatching nested number", "alert.signature_id=1", Event{}, false},
+		{"matching nested string", "dns.rrname=example.com", Event{}, true},
+		{"missing path", "dns.rrtype=A", Event{}, false},
+		{"missing intermediate key", "tls.sni=example.com", Event{}, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := MatchExpression(tc.expr)(tc.event, raw)
+			if got != tc.want {
+				t.Errorf("MatchExpression(%q) = %v, want %v", tc.expr, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMatchExpressionInvalid(t *testing.T) {
+	if MatchExpression("no-equals-sign")(Event{}, map[string]interface{}{}) {
+		t.Error("expression without '=' should never match")
+	}
+}
+
+func TestRenderOutputTemplate(t *testing.T) {
+	event := Event{FlowID: 42, Timestamp: "2026-07-27T10:00:00.000000+0000"}
+	got := renderOutputTemplate("{flow_id}-{ts}.pcap", event)
+	want := "42-2026-07-27T10.00.00.000000+0000.pcap"
+	if got != want {
+		t.Errorf("renderOutputTemplate() = %q, want %q", got, want)
+	}
+}
+
+// TestWatcherSocketStopClosesOpenConnections checks that Stop unblocks a
+// readConn goroutine parked reading from a client that's still connected
+// but has gone quiet, instead of Run hanging forever waiting for connsWg.
+func TestWatcherSocketStopClosesOpenConnections(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "events.sock")
+
+	w := NewWatcher(WatcherConfig{
+		EventPath: socketPath,
+		Socket:    true,
+		Match:     func(Event, map[string]interface{}) bool { return false },
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- w.Run() }()
+
+	var conn net.Conn
+	for i := 0; i < 100; i++ {
+		var err error
+		conn, err = net.Dial("unix", socketPath)
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if conn == nil {
+		t.Fatal("could not dial watcher socket")
+	}
+	defer conn.Close()
+
+	w.Stop()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run() did not return after Stop() with an open, idle connection")
+	}
+	w.Close()
+}